@@ -0,0 +1,83 @@
+package spanlogger
+
+import (
+	"io"
+	"sync/atomic"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	jaeger "github.com/uber/jaeger-client-go"
+	jaegercfg "github.com/uber/jaeger-client-go/config"
+)
+
+// Features holds runtime-toggleable flags that control tracing and
+// log-correlation behaviour. TraceEnabled is read when a SpanLogger is
+// created; LogCorrelationEnabled is read when a SpanLogger first logs.
+// Both flags default to enabled, matching the package's behaviour before
+// they existed.
+type Features struct {
+	TraceEnabled          atomic.Bool
+	LogCorrelationEnabled atomic.Bool
+}
+
+var globalFeatures = newEnabledFeatures()
+
+func newEnabledFeatures() *Features {
+	f := &Features{}
+	f.TraceEnabled.Store(true)
+	f.LogCorrelationEnabled.Store(true)
+	return f
+}
+
+// SetTraceEnabled toggles trace publishing for SpanLoggers created after the
+// call. When disabled, New and NewWithLogger return a SpanLogger backed by a
+// no-op span regardless of context, so callers stop paying for tracing
+// without having to change any call sites.
+func SetTraceEnabled(enabled bool) {
+	globalFeatures.TraceEnabled.Store(enabled)
+}
+
+// SetLogCorrelationEnabled toggles trace_id injection into log lines for
+// SpanLoggers that first log (or first call SetSpanAndLogTag) after the call;
+// SpanLoggers that have already logged keep the setting they logged with.
+func SetLogCorrelationEnabled(enabled bool) {
+	globalFeatures.LogCorrelationEnabled.Store(enabled)
+}
+
+// nopCloser is returned by InitTracingAndLogCorrelation when tracing is
+// disabled, so callers can unconditionally defer closer.Close().
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// InitTracingAndLogCorrelation constructs a Jaeger tracer reporting to
+// agentAddr, registers it as the opentracing global tracer, and sets the
+// package's runtime feature flags accordingly. The returned io.Closer should
+// be closed on shutdown to flush any spans still buffered. When traceEnabled
+// is false, no tracer is constructed and a no-op closer is returned; callers
+// that later flip tracing on with SetTraceEnabled must call
+// InitTracingAndLogCorrelation again to actually install a tracer.
+func InitTracingAndLogCorrelation(traceEnabled bool, agentAddr string, logCorrelation bool) (io.Closer, error) {
+	globalFeatures.TraceEnabled.Store(traceEnabled)
+	globalFeatures.LogCorrelationEnabled.Store(logCorrelation)
+
+	if !traceEnabled {
+		return nopCloser{}, nil
+	}
+
+	cfg := jaegercfg.Configuration{
+		ServiceName: "cortex",
+		Sampler: &jaegercfg.SamplerConfig{
+			Type:  jaeger.SamplerTypeConst,
+			Param: 1,
+		},
+		Reporter: &jaegercfg.ReporterConfig{
+			LocalAgentHostPort: agentAddr,
+		},
+	}
+	tracer, closer, err := cfg.NewTracer()
+	if err != nil {
+		return nil, err
+	}
+	opentracing.SetGlobalTracer(tracer)
+	return closer, nil
+}
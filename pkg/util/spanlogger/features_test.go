@@ -0,0 +1,53 @@
+package spanlogger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/stretchr/testify/require"
+	jaeger "github.com/uber/jaeger-client-go"
+)
+
+func TestSpanLogger_TraceDisabled(t *testing.T) {
+	mockTracer := mocktracer.New()
+	opentracing.SetGlobalTracer(mockTracer)
+
+	SetTraceEnabled(false)
+	defer SetTraceEnabled(true)
+
+	span, _ := New(context.Background(), "test")
+	require.Equal(t, defaultNoopSpan, span.Span)
+	require.Empty(t, mockTracer.FinishedSpans())
+}
+
+func TestSpanLogger_LogCorrelationDisabled(t *testing.T) {
+	// A jaeger tracer, so that trace_id would be logged if correlation were on.
+	tracer, closer := jaeger.NewTracer("test", jaeger.NewConstSampler(true), jaeger.NewNullReporter())
+	defer closer.Close()
+	opentracing.SetGlobalTracer(tracer)
+
+	SetLogCorrelationEnabled(false)
+	defer SetLogCorrelationEnabled(true)
+
+	var logged [][]interface{}
+	var logger funcLogger = func(keyvals ...interface{}) error {
+		logged = append(logged, keyvals)
+		return nil
+	}
+
+	span, _ := NewWithLogger(context.Background(), logger, "test")
+	_ = span.Log("msg", "hello")
+	require.NotContains(t, logged[0], "trace_id")
+}
+
+func TestInitTracingAndLogCorrelation_Disabled(t *testing.T) {
+	closer, err := InitTracingAndLogCorrelation(false, "localhost:6831", true)
+	require.NoError(t, err)
+	require.NoError(t, closer.Close())
+	require.False(t, globalFeatures.TraceEnabled.Load())
+
+	// Restore defaults for subsequent tests.
+	globalFeatures.TraceEnabled.Store(true)
+}
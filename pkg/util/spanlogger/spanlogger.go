@@ -2,11 +2,18 @@ package spanlogger
 
 import (
 	"context"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
 	otlog "github.com/opentracing/opentracing-go/log"
+	jaeger "github.com/uber/jaeger-client-go"
 
 	"github.com/cortexproject/cortex/pkg/tenant"
 	util_log "github.com/cortexproject/cortex/pkg/util/log"
@@ -15,17 +22,56 @@ import (
 type loggerCtxMarker struct{}
 
 const (
+	// TenantIDTagName is the span tag under which the tenant IDs resolved from
+	// the context are set, as a []string, when there's more than one tenant.
 	TenantIDTagName = "tenant_ids"
+	// SingleTenantIDTagName is the span tag under which the tenant ID resolved
+	// from the context is set, as a string, when there's exactly one tenant.
+	SingleTenantIDTagName = "tenant_id"
 )
 
 var (
 	loggerCtxKey = &loggerCtxMarker{}
+
+	// defaultNoopSpan is used whenever a SpanLogger can't find a real span to
+	// attach to, so that Span is never nil.
+	defaultNoopSpan = opentracing.NoopTracer{}.StartSpan("")
 )
 
-// SpanLogger unifies tracing and logging, to reduce repetition.
+// TenantResolver decouples SpanLogger from pkg/tenant, so that the package can
+// be reused in forks, or tests, that have a different tenant model.
+type TenantResolver interface {
+	// TenantID returns exactly one tenant ID, or an error if the context
+	// doesn't contain exactly one.
+	TenantID(ctx context.Context) (string, error)
+	// TenantIDs returns all tenant IDs present in the context.
+	TenantIDs(ctx context.Context) ([]string, error)
+}
+
+// defaultTenantResolver delegates to pkg/tenant, preserving the behaviour of
+// New and NewWithLogger for existing callers.
+type defaultTenantResolver struct{}
+
+func (defaultTenantResolver) TenantID(ctx context.Context) (string, error) {
+	return tenant.TenantID(ctx)
+}
+
+func (defaultTenantResolver) TenantIDs(ctx context.Context) ([]string, error) {
+	return tenant.TenantIDs(ctx)
+}
+
+// SpanLogger unifies tracing and logging, to reduce repetition. The
+// go-kit logger that Log writes to (with "method", trace_id and caller
+// attached) is built lazily, on first use, and cached: constructing a
+// SpanLogger that never logs anything, which is the common case for
+// short-lived spans, does no extra work. Building it lazily also lets
+// SetSpanAndLogTag extend it later without racing Log.
 type SpanLogger struct {
-	log.Logger
 	opentracing.Span
+
+	method     string
+	baseLogger log.Logger
+	logger     atomic.Pointer[log.Logger]
 }
 
 // New makes a new SpanLogger, where logs will be sent to the global logger.
@@ -37,13 +83,24 @@ func New(ctx context.Context, method string, kvps ...interface{}) (*SpanLogger,
 // to. The provided context will have the logger attached to it and can be
 // retrieved with FromContext or FromContextWithFallback.
 func NewWithLogger(ctx context.Context, l log.Logger, method string, kvps ...interface{}) (*SpanLogger, context.Context) {
-	span, ctx := opentracing.StartSpanFromContext(ctx, method)
-	if ids, _ := tenant.TenantIDs(ctx); len(ids) > 0 {
-		span.SetTag(TenantIDTagName, ids)
+	return NewWithTenantResolver(ctx, l, defaultTenantResolver{}, method, kvps...)
+}
+
+// NewWithTenantResolver makes a new SpanLogger with a custom log.Logger and a
+// custom TenantResolver, for callers that don't want to depend on pkg/tenant.
+// The provided context will have the logger attached to it and can be
+// retrieved with FromContext or FromContextWithFallback.
+func NewWithTenantResolver(ctx context.Context, l log.Logger, resolver TenantResolver, method string, kvps ...interface{}) (*SpanLogger, context.Context) {
+	span := opentracing.Span(defaultNoopSpan)
+	if globalFeatures.TraceEnabled.Load() {
+		span, ctx = opentracing.StartSpanFromContext(ctx, method)
+		tagTenant(span, resolver, ctx)
 	}
+
 	logger := &SpanLogger{
-		Logger: log.With(util_log.WithContext(ctx, l), "method", method),
-		Span:   span,
+		Span:       span,
+		method:     method,
+		baseLogger: util_log.WithContext(ctx, l),
 	}
 	if len(kvps) > 0 {
 		level.Debug(logger).Log(kvps...)
@@ -53,6 +110,95 @@ func NewWithLogger(ctx context.Context, l log.Logger, method string, kvps ...int
 	return logger, ctx
 }
 
+// spanLoggerPackage and goKitLogPackage are the import paths of packages
+// whose stack frames should never be reported by spanLoggerAwareCaller: this
+// package, which wraps the caller's logger, and go-kit's log package, which
+// evaluates bound Valuers (including spanLoggerAwareCaller itself) on the
+// caller's behalf.
+const (
+	spanLoggerPackage = "github.com/cortexproject/cortex/pkg/util/spanlogger"
+	goKitLogPackage   = "github.com/go-kit/kit/log"
+)
+
+// spanLoggerFrameNames holds the (unqualified) names of functions and methods
+// in this package that wrap the caller's log.Logger. Because tests for this
+// package live in the same package, a bare import-path prefix match isn't
+// enough to tell "internal plumbing" apart from "the code under test that
+// happens to log" - so frames in spanLoggerPackage are only skipped when
+// their name is in this set.
+var spanLoggerFrameNames = map[string]bool{
+	"Log":       true,
+	"logInner":  true,
+	"getLogger": true,
+}
+
+// spanLoggerAwareCaller is a log.Valuer, like log.Caller, except it skips
+// stack frames that belong to this package's or go-kit's logging machinery.
+// go-kit's own log.Caller(depth) hard-codes a stack depth, so wrapping the
+// caller's logger inside SpanLogger.Log corrupts the reported caller to
+// always be spanlogger.go; walking the stack until the first frame that
+// isn't logging machinery fixes that regardless of how deep the wrapping is.
+func spanLoggerAwareCaller() log.Valuer {
+	return func() interface{} {
+		for depth := 3; ; depth++ {
+			pc, file, line, ok := runtime.Caller(depth)
+			if !ok {
+				return "<unknown>"
+			}
+			if !isLoggingMachineryFrame(pc) {
+				return fmt.Sprintf("%s:%d", filepath.Base(file), line)
+			}
+		}
+	}
+}
+
+// isLoggingMachineryFrame reports whether pc belongs to code that evaluates
+// or wraps loggers on behalf of the actual caller, and so should never be
+// reported as the caller itself.
+func isLoggingMachineryFrame(pc uintptr) bool {
+	fn := runtime.FuncForPC(pc)
+	if fn == nil {
+		return false
+	}
+	name := fn.Name()
+	if strings.HasPrefix(name, goKitLogPackage+".") {
+		return true
+	}
+	if strings.HasPrefix(name, spanLoggerPackage+".") {
+		short := name[strings.LastIndex(name, ".")+1:]
+		return spanLoggerFrameNames[short]
+	}
+	return false
+}
+
+// withTraceID returns logger with a trace_id key-value pair appended, derived
+// from span's context. It's a no-op when span doesn't hold a real trace (e.g.
+// defaultNoopSpan) or its SpanContext isn't one we know how to read a trace ID
+// out of: only a jaeger.SpanContext (the only tracer cortex runs in
+// production) is read.
+func withTraceID(span opentracing.Span, logger log.Logger) log.Logger {
+	if span == defaultNoopSpan {
+		return logger
+	}
+	if sc, ok := span.Context().(jaeger.SpanContext); ok {
+		return log.With(logger, "trace_id", sc.TraceID().String())
+	}
+	return logger
+}
+
+// tagTenant tags span with the tenant ID(s) resolved from ctx: a single string
+// under SingleTenantIDTagName when there's exactly one tenant, or a []string
+// under TenantIDTagName otherwise.
+func tagTenant(span opentracing.Span, resolver TenantResolver, ctx context.Context) {
+	if id, err := resolver.TenantID(ctx); err == nil {
+		span.SetTag(SingleTenantIDTagName, id)
+		return
+	}
+	if ids, err := resolver.TenantIDs(ctx); err == nil && len(ids) > 0 {
+		span.SetTag(TenantIDTagName, ids)
+	}
+}
+
 // FromContext returns a span logger using the current parent span. If there
 // is no parent span, the SpanLogger will only log to the logger
 // in the context. If the context doesn't have a logger, the global logger
@@ -75,15 +221,50 @@ func FromContextWithFallback(ctx context.Context, fallback log.Logger) *SpanLogg
 		sp = defaultNoopSpan
 	}
 	return &SpanLogger{
-		Logger: util_log.WithContext(ctx, logger),
-		Span:   sp,
+		Span:       sp,
+		baseLogger: util_log.WithContext(ctx, logger),
+	}
+}
+
+// getLogger returns the fully-assembled logger for s, building it on first
+// use and caching it for subsequent calls. It's safe for concurrent use.
+func (s *SpanLogger) getLogger() log.Logger {
+	if p := s.logger.Load(); p != nil {
+		return *p
+	}
+	logger := s.baseLogger
+	if s.method != "" {
+		logger = log.With(logger, "method", s.method)
+	}
+	if globalFeatures.LogCorrelationEnabled.Load() {
+		logger = withTraceID(s.Span, logger)
+	}
+	logger = log.With(logger, "caller", spanLoggerAwareCaller())
+	s.logger.CompareAndSwap(nil, &logger)
+	return *s.logger.Load()
+}
+
+// SetSpanAndLogTag sets key=value as a tag on the span, and permanently
+// attaches it to every subsequent log line written through Log. It's meant
+// for request handlers that accumulate context (e.g. "user_id", "query_id")
+// over the life of a span, and is safe to call concurrently with Log.
+func (s *SpanLogger) SetSpanAndLogTag(key string, value interface{}) {
+	s.Span.SetTag(key, value)
+
+	s.getLogger() // ensure the logger is initialized before we start swapping it
+	for {
+		p := s.logger.Load()
+		updated := log.With(*p, key, value)
+		if s.logger.CompareAndSwap(p, &updated) {
+			return
+		}
 	}
 }
 
 // Log implements gokit's Logger interface; sends logs to underlying logger and
 // also puts the on the spans.
 func (s *SpanLogger) Log(kvps ...interface{}) error {
-	s.Logger.Log(kvps...)
+	s.getLogger().Log(kvps...)
 
 	fields, err, _, _ := s.logInner(kvps...)
 	if err != nil {
@@ -130,3 +311,57 @@ func (s *SpanLogger) Error(err error) error {
 	s.Span.LogFields(otlog.Error(err))
 	return err
 }
+
+// Finish finishes the span tracked by this SpanLogger.
+func (s *SpanLogger) Finish() {
+	s.Span.Finish()
+}
+
+// SetTag sets a tag on the span tracked by this SpanLogger.
+func (s *SpanLogger) SetTag(key string, value interface{}) {
+	s.Span.SetTag(key, value)
+}
+
+// FinishWithErr finishes the span, marking it as failed and logging err on it
+// when err is non-nil. It returns err unchanged, so it can be used to wrap the
+// return statement of the function the SpanLogger was created for, e.g.
+// `return s.FinishWithErr(doSomething())`.
+func (s *SpanLogger) FinishWithErr(err error) error {
+	if err != nil {
+		ext.Error.Set(s.Span, true)
+		s.Span.LogFields(otlog.Error(err))
+	}
+	s.Span.Finish()
+	return err
+}
+
+// StartFromParentState starts a new span as a child of a span context
+// deserialized from carrier using format (e.g. opentracing.TextMap or
+// opentracing.Binary), and wraps it in a SpanLogger. This allows a trace to be
+// continued across process boundaries without the caller having to touch
+// opentracing.GlobalTracer() directly. If carrier doesn't hold a valid span
+// context, the span is started from ctx instead, as NewWithLogger does: a
+// child of the span in ctx if there is one, parentless otherwise. Like New and
+// NewWithLogger, it returns a SpanLogger backed by a no-op span, regardless of
+// carrier, when globalFeatures.TraceEnabled is false.
+func StartFromParentState(ctx context.Context, method string, format opentracing.BuiltinFormat, carrier interface{}) (*SpanLogger, context.Context) {
+	if !globalFeatures.TraceEnabled.Load() {
+		return NewWithLogger(ctx, util_log.Logger, method)
+	}
+
+	tracer := opentracing.GlobalTracer()
+	parentCtx, err := tracer.Extract(format, carrier)
+	if err != nil {
+		return NewWithLogger(ctx, util_log.Logger, method)
+	}
+
+	span := tracer.StartSpan(method, opentracing.ChildOf(parentCtx))
+	ctx = opentracing.ContextWithSpan(ctx, span)
+	logger := &SpanLogger{
+		Span:       span,
+		method:     method,
+		baseLogger: util_log.WithContext(ctx, util_log.Logger),
+	}
+	ctx = context.WithValue(ctx, loggerCtxKey, util_log.Logger)
+	return logger, ctx
+}
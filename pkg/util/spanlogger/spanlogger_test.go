@@ -2,6 +2,8 @@ package spanlogger
 
 import (
 	"context"
+	"fmt"
+	"sync"
 	"testing"
 
 	"github.com/go-kit/kit/log"
@@ -9,6 +11,7 @@ import (
 	"github.com/opentracing/opentracing-go/mocktracer"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
+	jaeger "github.com/uber/jaeger-client-go"
 	"github.com/weaveworks/common/user"
 )
 
@@ -78,18 +81,43 @@ func TestSpanLogger_CustomLogger(t *testing.T) {
 	span = FromContextWithFallback(context.Background(), logger)
 	_ = span.Log("msg", "fallback spanlogger")
 
-	expect := [][]interface{}{
-		{"method", "test", "msg", "original spanlogger"},
-		{"msg", "restored spanlogger"},
-		{"msg", "fallback spanlogger"},
+	require.Len(t, logged, 3)
+	require.Equal(t, "test", value(logged[0], "method"))
+	require.Equal(t, "original spanlogger", value(logged[0], "msg"))
+	_, hasMethod := lookup(logged[1], "method")
+	require.False(t, hasMethod)
+	require.Equal(t, "restored spanlogger", value(logged[1], "msg"))
+	require.Equal(t, "fallback spanlogger", value(logged[2], "msg"))
+}
+
+// value returns the value associated with key in a flat key-value slice, as
+// passed to a go-kit log.Logger.
+func value(keyvals []interface{}, key string) interface{} {
+	v, _ := lookup(keyvals, key)
+	return v
+}
+
+func lookup(keyvals []interface{}, key string) (interface{}, bool) {
+	for i := 0; i < len(keyvals)-1; i += 2 {
+		if keyvals[i] == key {
+			return keyvals[i+1], true
+		}
 	}
-	require.Equal(t, expect, logged)
+	return nil, false
 }
 
 func TestSpanCreatedWithTenantTag(t *testing.T) {
 	mockSpan := createSpan(user.InjectOrgID(context.Background(), "team-a"))
 
-	require.Equal(t, []string{"team-a"}, mockSpan.Tag(TenantIDTagName))
+	require.Equal(t, "team-a", mockSpan.Tag(SingleTenantIDTagName))
+}
+
+func TestSpanCreatedWithMultipleTenantsTag(t *testing.T) {
+	mockSpan := createSpan(user.InjectOrgID(context.Background(), "team-a|team-b"))
+
+	require.Equal(t, []string{"team-a", "team-b"}, mockSpan.Tag(TenantIDTagName))
+	_, exist := mockSpan.Tags()[SingleTenantIDTagName]
+	require.False(t, exist)
 }
 
 func TestSpanCreatedWithoutTenantTag(t *testing.T) {
@@ -97,6 +125,181 @@ func TestSpanCreatedWithoutTenantTag(t *testing.T) {
 
 	_, exist := mockSpan.Tags()[TenantIDTagName]
 	require.False(t, exist)
+	_, exist = mockSpan.Tags()[SingleTenantIDTagName]
+	require.False(t, exist)
+}
+
+func TestSpanLoggerAwareCaller(t *testing.T) {
+	var logged [][]interface{}
+	var logger funcLogger = func(keyvals ...interface{}) error {
+		logged = append(logged, keyvals)
+		return nil
+	}
+
+	span, _ := NewWithLogger(context.Background(), logger, "test")
+	logFromDepth0(t, span)
+	logFromDepth1(t, span)
+
+	for _, keyvals := range logged {
+		caller, ok := callerValue(keyvals)
+		require.True(t, ok)
+		require.Contains(t, caller, "spanlogger_test.go")
+		require.NotContains(t, caller, "spanlogger.go")
+	}
+}
+
+func logFromDepth0(t *testing.T, span *SpanLogger) {
+	t.Helper()
+	require.NoError(t, span.Log("msg", "depth0"))
+}
+
+func logFromDepth1(t *testing.T, span *SpanLogger) {
+	t.Helper()
+	logFromDepth0(t, span)
+}
+
+func callerValue(keyvals []interface{}) (string, bool) {
+	v, ok := lookup(keyvals, "caller")
+	if !ok {
+		return "", false
+	}
+	if valuer, ok := v.(log.Valuer); ok {
+		return fmt.Sprint(valuer()), true
+	}
+	return fmt.Sprint(v), true
+}
+
+func TestSpanLogger_LogsTraceID(t *testing.T) {
+	tracer, closer := jaeger.NewTracer("test", jaeger.NewConstSampler(true), jaeger.NewNullReporter())
+	defer closer.Close()
+	opentracing.SetGlobalTracer(tracer)
+
+	var logged [][]interface{}
+	var logger funcLogger = func(keyvals ...interface{}) error {
+		logged = append(logged, keyvals)
+		return nil
+	}
+
+	span, _ := NewWithLogger(context.Background(), logger, "test")
+	_ = span.Log("msg", "with span")
+	require.Contains(t, logged[len(logged)-1], "trace_id")
+
+	logged = nil
+	noSpan := FromContextWithFallback(context.Background(), logger)
+	_ = noSpan.Log("msg", "no span")
+	require.NotContains(t, logged[len(logged)-1], "trace_id")
+}
+
+func TestSpanLogger_SetSpanAndLogTag(t *testing.T) {
+	mockTracer := mocktracer.New()
+	opentracing.SetGlobalTracer(mockTracer)
+
+	var logged [][]interface{}
+	var logger funcLogger = func(keyvals ...interface{}) error {
+		logged = append(logged, keyvals)
+		return nil
+	}
+
+	span, _ := NewWithLogger(context.Background(), logger, "test")
+	_ = span.Log("msg", "before")
+	require.NotContains(t, logged[0], "user_id")
+
+	span.SetSpanAndLogTag("user_id", "user-1")
+	_ = span.Log("msg", "after")
+	require.Equal(t, "user-1", value(logged[1], "user_id"))
+
+	mockSpan := span.Span.(*mocktracer.MockSpan)
+	require.Equal(t, "user-1", mockSpan.Tag("user_id"))
+}
+
+func TestSpanLogger_SetSpanAndLogTagConcurrentWithLog(t *testing.T) {
+	mockTracer := mocktracer.New()
+	opentracing.SetGlobalTracer(mockTracer)
+
+	var mu sync.Mutex
+	var logged [][]interface{}
+	var logger funcLogger = func(keyvals ...interface{}) error {
+		mu.Lock()
+		logged = append(logged, keyvals)
+		mu.Unlock()
+		return nil
+	}
+
+	span, _ := NewWithLogger(context.Background(), logger, "test")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			span.SetSpanAndLogTag(fmt.Sprintf("tag%d", i), i)
+		}(i)
+		go func() {
+			defer wg.Done()
+			_ = span.Log("msg", "concurrent")
+		}()
+	}
+	wg.Wait()
+
+	// Every tag set concurrently must survive: both on the span, and baked
+	// into the logger that Log writes through from now on.
+	mockSpan := span.Span.(*mocktracer.MockSpan)
+	for i := 0; i < 10; i++ {
+		require.Equal(t, i, mockSpan.Tag(fmt.Sprintf("tag%d", i)))
+	}
+
+	_ = span.Log("msg", "final")
+	mu.Lock()
+	final := logged[len(logged)-1]
+	mu.Unlock()
+	for i := 0; i < 10; i++ {
+		require.Equal(t, i, value(final, fmt.Sprintf("tag%d", i)))
+	}
+}
+
+func TestSpanLogger_FinishWithErr(t *testing.T) {
+	mockTracer := mocktracer.New()
+	opentracing.SetGlobalTracer(mockTracer)
+
+	span, _ := New(context.Background(), "test")
+	err := span.FinishWithErr(errors.New("boom"))
+	require.EqualError(t, err, "boom")
+
+	mockSpan := span.Span.(*mocktracer.MockSpan)
+	require.True(t, mockSpan.Tag("error").(bool))
+	require.NotEmpty(t, mockSpan.FinishTime)
+
+	span, _ = New(context.Background(), "test")
+	require.NoError(t, span.FinishWithErr(nil))
+	require.Nil(t, span.Span.(*mocktracer.MockSpan).Tag("error"))
+}
+
+func TestStartFromParentState_TraceDisabled(t *testing.T) {
+	mockTracer := mocktracer.New()
+	opentracing.SetGlobalTracer(mockTracer)
+
+	parent, ctx := New(context.Background(), "parent")
+	carrier := opentracing.TextMapCarrier{}
+	require.NoError(t, mockTracer.Inject(parent.Span.Context(), opentracing.TextMap, carrier))
+
+	SetTraceEnabled(false)
+	defer SetTraceEnabled(true)
+
+	child, _ := StartFromParentState(ctx, "child", opentracing.TextMap, carrier)
+	require.Equal(t, defaultNoopSpan, child.Span)
+}
+
+func TestStartFromParentState(t *testing.T) {
+	mockTracer := mocktracer.New()
+	opentracing.SetGlobalTracer(mockTracer)
+
+	parent, ctx := New(context.Background(), "parent")
+	carrier := opentracing.TextMapCarrier{}
+	require.NoError(t, mockTracer.Inject(parent.Span.Context(), opentracing.TextMap, carrier))
+
+	child, _ := StartFromParentState(ctx, "child", opentracing.TextMap, carrier)
+	childSpan := child.Span.(*mocktracer.MockSpan)
+	require.Equal(t, parent.Span.(*mocktracer.MockSpan).SpanContext.SpanID, childSpan.ParentID)
 }
 
 func createSpan(ctx context.Context) *mocktracer.MockSpan {